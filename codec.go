@@ -0,0 +1,207 @@
+package readconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Codec marshals and unmarshals configuration data to and from a Go value.
+// Config.ReadInto, Config.WriteFrom, and Config.ListenInto use a Codec to
+// spare callers from re-parsing the raw bytes returned by Read.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec (de)serializes configuration data as JSON.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// YAMLCodec (de)serializes configuration data as YAML.
+type YAMLCodec struct{}
+
+func (YAMLCodec) Marshal(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+func (YAMLCodec) Unmarshal(data []byte, v interface{}) error {
+	return yaml.Unmarshal(data, v)
+}
+
+// TOMLCodec (de)serializes configuration data as TOML.
+type TOMLCodec struct{}
+
+func (TOMLCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (TOMLCodec) Unmarshal(data []byte, v interface{}) error {
+	return toml.Unmarshal(data, v)
+}
+
+// INICodec (de)serializes configuration data as flat INI key=value pairs.
+// Struct fields are matched by an "ini" tag, falling back to the field
+// name; it has no notion of sections and is meant for the common case of a
+// single unnamed group of settings. A *map[string]interface{} destination
+// is also supported, for callers (such as Layered) that need to inspect
+// keys generically rather than through a known struct.
+type INICodec struct{}
+
+func (INICodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(map[string]interface{}); ok {
+		return marshalINIMap(m), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.New("readconf: INICodec can only marshal a struct or map[string]interface{}")
+	}
+
+	var buf bytes.Buffer
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		fmt.Fprintf(&buf, "%s=%v\n", iniFieldName(rt.Field(i)), rv.Field(i).Interface())
+	}
+	return buf.Bytes(), nil
+}
+
+func marshalINIMap(m map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	for k, v := range m {
+		fmt.Fprintf(&buf, "%s=%v\n", k, v)
+	}
+	return buf.Bytes()
+}
+
+func (INICodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(*map[string]interface{}); ok {
+		return unmarshalINIMap(data, m)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("readconf: INICodec can only unmarshal into a struct pointer or *map[string]interface{}")
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	fields := make(map[string]int, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		fields[iniFieldName(rt.Field(i))] = i
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "[") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		i, ok := fields[key]
+		if !ok {
+			continue
+		}
+
+		if err := setIniField(rv.Field(i), value); err != nil {
+			return fmt.Errorf("readconf: field %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func unmarshalINIMap(data []byte, m *map[string]interface{}) error {
+	if *m == nil {
+		*m = make(map[string]interface{})
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "[") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		(*m)[key] = value
+	}
+	return nil
+}
+
+func iniFieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("ini"); tag != "" {
+		return tag
+	}
+	return field.Name
+}
+
+func setIniField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	}
+	return nil
+}
+
+// codecForExt returns the built-in Codec matching confName's file
+// extension, defaulting to INICodec when the extension is unrecognised.
+func codecForExt(confName string) Codec {
+	switch strings.ToLower(path.Ext(confName)) {
+	case ".json":
+		return JSONCodec{}
+	case ".yaml", ".yml":
+		return YAMLCodec{}
+	case ".toml":
+		return TOMLCodec{}
+	default:
+		return INICodec{}
+	}
+}
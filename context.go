@@ -0,0 +1,76 @@
+package readconf
+
+import (
+	"context"
+	"os"
+)
+
+// Options carries the per-call overrides readconf otherwise reads from the
+// environment: the roots it searches for a user, system, and fallback
+// configuration, and the Filesystem used to reach them. A zero Options
+// falls back to $XDG_CONFIG_HOME/$HOME, "/etc", "/tmp", and the local
+// disk, exactly like calling the package functions without a context
+// built from WithOptions.
+type Options struct {
+	XDGConfigHome string
+	Home          string
+	EtcRoot       string
+	TmpRoot       string
+	FS            Filesystem
+}
+
+type contextKey struct{}
+
+// WithOptions returns a copy of ctx carrying opts, so that Get and
+// NewLayered resolve the roots and Filesystem that Options carries from
+// opts instead of the process environment and the local disk. A Config
+// they return keeps using that Filesystem for Read, Write, and Listen,
+// whatever context those are later called with. This is modelled on how rclone deglobalised
+// fs.Config onto a context.Context.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, contextKey{}, opts)
+}
+
+// FromContext returns the Options stored in ctx by WithOptions, or the
+// zero Options if none were set.
+func FromContext(ctx context.Context) Options {
+	opts, _ := ctx.Value(contextKey{}).(Options)
+	return opts
+}
+
+// xdgConfigHome returns the user configuration root to search, honouring
+// an Options override before falling back to the environment.
+func (o Options) xdgConfigHome() string {
+	if o.XDGConfigHome != "" {
+		return o.XDGConfigHome
+	}
+	return os.Getenv("XDG_CONFIG_HOME")
+}
+
+func (o Options) home() string {
+	if o.Home != "" {
+		return o.Home
+	}
+	return os.Getenv("HOME")
+}
+
+func (o Options) etcRoot() string {
+	if o.EtcRoot != "" {
+		return o.EtcRoot
+	}
+	return "/etc"
+}
+
+func (o Options) tmpRoot() string {
+	if o.TmpRoot != "" {
+		return o.TmpRoot
+	}
+	return "/tmp"
+}
+
+func (o Options) filesystem() Filesystem {
+	if o.FS != nil {
+		return o.FS
+	}
+	return OSFilesystem{}
+}
@@ -0,0 +1,318 @@
+package readconf
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is the subset of *os.File that a Filesystem hands back from Open
+// and Create.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+// Filesystem abstracts the file operations readconf needs to locate, read,
+// and write configuration files, so a Config can run against something
+// other than the local disk. See OSFilesystem (the default), MemFilesystem
+// (for tests), and BasePathFilesystem (for sandboxing a real disk layout
+// under one root), modelled on spf13/afero's Fs.
+type Filesystem interface {
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// SyncDir flushes directory metadata (e.g. the entry created by a
+	// rename over an existing file) to stable storage.
+	SyncDir(dir string) error
+	// WatchPath translates name into a path a Watcher (see Listen) can
+	// actually watch for changes, and reports whether that's possible at
+	// all. It exists because a Watcher always watches the real disk,
+	// bypassing this Filesystem abstraction entirely; a Filesystem backed
+	// by something other than the real disk -- MemFilesystem -- has no
+	// such path and returns ok == false, so Listen can fail loudly
+	// instead of silently watching the wrong location.
+	WatchPath(name string) (watchable string, ok bool)
+}
+
+// OSFilesystem implements Filesystem on top of the local disk. It is the
+// default used when no other Filesystem is supplied through Options.
+type OSFilesystem struct{}
+
+func (OSFilesystem) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OSFilesystem) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (OSFilesystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFilesystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFilesystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (OSFilesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (OSFilesystem) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// WatchPath returns name as-is: it is already a real disk path.
+func (OSFilesystem) WatchPath(name string) (string, bool) {
+	return name, true
+}
+
+// MemFilesystem is an in-memory Filesystem, modelled on spf13/afero's
+// MemMapFs. It lets tests exercise Get, Read, and Write without depending
+// on real system paths such as /etc/fonts/fonts.conf existing on the host.
+// Listen refuses to run against it (see WatchPath).
+type MemFilesystem struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+// NewMemFilesystem returns an empty MemFilesystem.
+func NewMemFilesystem() *MemFilesystem {
+	return &MemFilesystem{
+		files: make(map[string][]byte),
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+func (fs *MemFilesystem) Open(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{name: name, fs: fs, buf: bytes.NewBuffer(append([]byte(nil), data...))}, nil
+}
+
+func (fs *MemFilesystem) Create(name string) (File, error) {
+	fs.mu.Lock()
+	fs.files[name] = nil
+	fs.mu.Unlock()
+
+	return &memFile{name: name, fs: fs, buf: new(bytes.Buffer)}, nil
+}
+
+func (fs *MemFilesystem) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if data, ok := fs.files[name]; ok {
+		return memFileInfo{name: path.Base(name), size: int64(len(data))}, nil
+	}
+	if fs.dirs[name] {
+		return memFileInfo{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFilesystem) MkdirAll(dir string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for dir != "/" && dir != "." && dir != "" {
+		fs.dirs[dir] = true
+		dir = path.Dir(dir)
+	}
+	return nil
+}
+
+func (fs *MemFilesystem) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *MemFilesystem) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[oldpath]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+	fs.files[newpath] = data
+	delete(fs.files, oldpath)
+	return nil
+}
+
+func (fs *MemFilesystem) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (fs *MemFilesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// SyncDir is a no-op: there is no metadata to flush in memory.
+func (fs *MemFilesystem) SyncDir(dir string) error {
+	return nil
+}
+
+// WatchPath always fails: a MemFilesystem's files don't exist anywhere a
+// Watcher could watch.
+func (fs *MemFilesystem) WatchPath(name string) (string, bool) {
+	return "", false
+}
+
+type memFile struct {
+	name string
+	fs   *MemFilesystem
+	buf  *bytes.Buffer
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	return f.buf.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	n, err := f.buf.Write(p)
+
+	f.fs.mu.Lock()
+	f.fs.files[f.name] = append([]byte(nil), f.buf.Bytes()...)
+	f.fs.mu.Unlock()
+
+	return n, err
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// Sync is a no-op: a memFile's writes are already visible to the rest of
+// the MemFilesystem as they happen.
+func (f *memFile) Sync() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi memFileInfo) Name() string { return fi.name }
+func (fi memFileInfo) Size() int64  { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir
+	}
+	return 0644
+}
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.isDir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// BasePathFilesystem wraps another Filesystem, rewriting the well-known
+// roots readconf searches ($XDG_CONFIG_HOME, $HOME, /etc, /tmp) onto a
+// single prefix, chroot-style. It lets tests exercise Get's full search
+// logic against a MemFilesystem or a throwaway temp directory instead of
+// the host's real /etc and /tmp.
+type BasePathFilesystem struct {
+	Base Filesystem
+	Root string
+}
+
+func (b BasePathFilesystem) rewrite(name string) string {
+	for _, root := range []string{os.Getenv("XDG_CONFIG_HOME"), os.Getenv("HOME"), "/etc", "/tmp"} {
+		if root != "" && strings.HasPrefix(name, root) {
+			return path.Join(b.Root, strings.TrimPrefix(name, root))
+		}
+	}
+	return path.Join(b.Root, name)
+}
+
+func (b BasePathFilesystem) Open(name string) (File, error) {
+	return b.Base.Open(b.rewrite(name))
+}
+
+func (b BasePathFilesystem) Create(name string) (File, error) {
+	return b.Base.Create(b.rewrite(name))
+}
+
+func (b BasePathFilesystem) Stat(name string) (os.FileInfo, error) {
+	return b.Base.Stat(b.rewrite(name))
+}
+
+func (b BasePathFilesystem) MkdirAll(dir string, perm os.FileMode) error {
+	return b.Base.MkdirAll(b.rewrite(dir), perm)
+}
+
+func (b BasePathFilesystem) Remove(name string) error {
+	return b.Base.Remove(b.rewrite(name))
+}
+
+func (b BasePathFilesystem) Rename(oldpath, newpath string) error {
+	return b.Base.Rename(b.rewrite(oldpath), b.rewrite(newpath))
+}
+
+func (b BasePathFilesystem) ReadFile(name string) ([]byte, error) {
+	return b.Base.ReadFile(b.rewrite(name))
+}
+
+func (b BasePathFilesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return b.Base.WriteFile(b.rewrite(name), data, perm)
+}
+
+func (b BasePathFilesystem) SyncDir(dir string) error {
+	return b.Base.SyncDir(b.rewrite(dir))
+}
+
+func (b BasePathFilesystem) WatchPath(name string) (string, bool) {
+	return b.Base.WatchPath(b.rewrite(name))
+}
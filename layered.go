@@ -0,0 +1,199 @@
+package readconf
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// xdgConfigDirs returns $XDG_CONFIG_DIRS split on ":", the system-wide
+// fallback search path the XDG base directory spec defines behind
+// $XDG_CONFIG_HOME, in the order they should be searched.
+func xdgConfigDirs() []string {
+	v := os.Getenv("XDG_CONFIG_DIRS")
+	if v == "" {
+		return nil
+	}
+
+	var dirs []string
+	for _, dir := range strings.Split(v, ":") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Layered presents several Config layers as a single merged view, most
+// specific first: conventionally the user configuration under
+// $XDG_CONFIG_HOME (or $HOME/.config), then each $XDG_CONFIG_DIRS entry,
+// then /etc. A key defined in an earlier layer wins over the same key in
+// a later one; everything else falls back to the next layer down.
+type Layered struct {
+	Layers []*Config
+
+	// userConf is the user's own layer, if NewLayered found one; it is nil
+	// when the user has no configuration of their own yet, in which case
+	// Reset materializes one at userPath rather than writing into a
+	// $XDG_CONFIG_DIRS or /etc layer.
+	userConf              *Config
+	userPath              string
+	programName, confName string
+}
+
+// NewLayered builds a Layered for programName/confName out of whichever
+// of the user configuration, $XDG_CONFIG_DIRS entries, and the system
+// configuration actually exist. It returns an error only if none of them
+// do.
+func NewLayered(ctx context.Context, programName, confName string) (*Layered, error) {
+	fs := FromContext(ctx).filesystem()
+
+	var layers []*Config
+	var userConf *Config
+
+	userOpts := FromContext(ctx)
+	userPath := userOpts.xdgConfigHome()
+	if userPath == "" {
+		if home := userOpts.home(); home != "" {
+			userPath = path.Join(home, ".config")
+		}
+	}
+	if userPath != "" {
+		if conf, err := findConfig(fs, userPath, programName, confName); err == nil {
+			layers = append(layers, conf)
+			userConf = conf
+		}
+	}
+
+	for _, dir := range xdgConfigDirs() {
+		if conf, err := findConfig(fs, dir, programName, confName); err == nil {
+			layers = append(layers, conf)
+		}
+	}
+
+	if sysConf, err := getSysConfig(ctx, programName, confName); err == nil {
+		layers = append(layers, sysConf)
+	}
+
+	if len(layers) == 0 {
+		return nil, errors.New("readconf: no configuration layer found for " + programName + "/" + confName)
+	}
+
+	return &Layered{
+		Layers:      layers,
+		userConf:    userConf,
+		userPath:    userPath,
+		programName: programName,
+		confName:    confName,
+	}, nil
+}
+
+// decode reads and decodes layer i with its Codec into a generic map, for
+// use by Merge and Origin. A layer that can't be read or decoded
+// contributes nothing rather than failing the whole operation.
+func (l *Layered) decode(ctx context.Context, i int) map[string]interface{} {
+	layer := l.Layers[i]
+
+	data, err := layer.Read(ctx)
+	if err != nil {
+		return nil
+	}
+
+	v := map[string]interface{}{}
+	if err := layer.codec.Unmarshal(data, &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// Merge reads every layer and deep-merges them into one map, with values
+// from more specific layers (lower index) overriding the same key in a
+// less specific one.
+func (l *Layered) Merge(ctx context.Context) map[string]interface{} {
+	merged := map[string]interface{}{}
+
+	for i := len(l.Layers) - 1; i >= 0; i-- {
+		deepMerge(merged, l.decode(ctx, i))
+	}
+
+	return merged
+}
+
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sub, ok := v.(map[string]interface{}); ok {
+			if existing, ok := dst[k].(map[string]interface{}); ok {
+				deepMerge(existing, sub)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// Origin reports the path of the most specific layer that defines key, or
+// "" if no layer does.
+func (l *Layered) Origin(ctx context.Context, key string) string {
+	for i, layer := range l.Layers {
+		if v := l.decode(ctx, i); v != nil {
+			if _, ok := v[key]; ok {
+				return layer.getPath()
+			}
+		}
+	}
+	return ""
+}
+
+// Reset deletes key's override from the user's own layer -- materializing
+// one (by copying the current most specific layer) if the user doesn't
+// have one of their own yet -- so that Merge falls back to whatever a
+// less specific layer supplies. It never writes into a $XDG_CONFIG_DIRS
+// or /etc layer, since Layers[0] is only the user's own layer when one
+// exists; those upstream layers are shared and meant to be read-only.
+func (l *Layered) Reset(ctx context.Context, key string) error {
+	user, err := l.userLayer(ctx)
+	if err != nil {
+		return err
+	}
+
+	v := map[string]interface{}{}
+	if data, err := user.Read(ctx); err == nil {
+		user.codec.Unmarshal(data, &v)
+	}
+	delete(v, key)
+
+	data, err := user.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = user.Write(ctx, data)
+	return err
+}
+
+// userLayer returns the user's own layer, materializing it by copying the
+// current most specific layer to userPath if the user doesn't have one of
+// their own yet.
+func (l *Layered) userLayer(ctx context.Context) (*Config, error) {
+	if l.userConf != nil {
+		return l.userConf, nil
+	}
+
+	if l.userPath == "" {
+		return nil, errors.New("readconf: no user configuration directory to reset " + l.programName + "/" + l.confName + " into")
+	}
+
+	if len(l.Layers) == 0 {
+		return nil, errors.New("readconf: no layers to reset")
+	}
+
+	conf, err := l.Layers[0].copyConf(ctx, l.userPath, l.programName, l.confName)
+	if err != nil {
+		return nil, err
+	}
+
+	l.userConf = conf
+	l.Layers = append([]*Config{conf}, l.Layers...)
+	return conf, nil
+}
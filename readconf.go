@@ -2,20 +2,43 @@
 // It tries to set a configuration path according to the existence of $XDG_CONFIG_HOME and falls back to $HOME/.config.
 //
 // It supports watching for file changes through inotify.
+//
+// ReadInto, WriteFrom, and ListenInto additionally decode the configuration
+// into caller-provided Go structs through a pluggable Codec, selected from
+// the configuration's file extension or overridden with WithCodec.
+//
+// All file access goes through a Filesystem, defaulting to the local disk
+// (OSFilesystem) but overridable per call via WithOptions, which is how
+// this package's own tests avoid depending on a real /etc or /tmp.
+//
+// The user copy of a configuration can also be encrypted at rest with a
+// Cipher; see WithPassphrase. Encryption is detected automatically from a
+// magic header, so an unencrypted legacy configuration keeps working even
+// once a Cipher is configured.
 package readconf
 
 import (
-	"code.google.com/p/go.exp/inotify"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// coalesceWindow bounds how long Listen waits after a qualifying event
+// before reading the configuration, so that the IN_MOVED_TO/IN_CREATE/
+// IN_MODIFY events produced by a single atomic Write collapse into one
+// update instead of being reported individually.
+const coalesceWindow = 10 * time.Millisecond
+
+// tmpSeq disambiguates the temp files Write creates for concurrent writes
+// to configurations sharing a directory.
+var tmpSeq uint64
+
 // Used to send and receive data and read write errors
 type ConfigData struct {
 	Data  <-chan []byte
@@ -28,56 +51,152 @@ type Config struct {
 	programName string // Used as the program's config dir
 	confName    string // Filename of the program's configuration
 	isTemporary bool
+	codec       Codec      // Used by ReadInto/WriteFrom/ListenInto to (de)serialize the configuration
+	fs          Filesystem // Used to reach programPath; defaults to OSFilesystem
+	cipher      Cipher     // If set, encrypts/decrypts the configuration at rest; see WithPassphrase
 	lock        sync.RWMutex
 }
 
+// Option configures optional behaviour of a Config, applied by Get.
+type Option func(*Config)
+
+// WithCodec overrides the Codec normally selected by confName's file
+// extension, e.g. to force JSON for a file without a ".json" suffix.
+func WithCodec(codec Codec) Option {
+	return func(c *Config) {
+		c.codec = codec
+	}
+}
+
+// WithPassphrase enables transparent NaCl secretbox encryption of the
+// configuration at rest (see Cipher), deriving the key from passphrase()
+// -- called lazily, so it can prompt a user or read a secrets manager
+// instead of holding the passphrase in memory up front. The scrypt salt
+// is the configuration's own programName/confName, for light domain
+// separation between configurations sharing a passphrase.
+func WithPassphrase(passphrase PassphraseFunc) Option {
+	return func(c *Config) {
+		c.cipher = NewSecretboxCipher(passphrase, []byte(path.Join(c.programName, c.confName)))
+	}
+}
+
+// applyOptions runs opts against conf, then -- if none of them configured
+// a Cipher -- falls back to the READCONF_PASSPHRASE environment variable,
+// so transparent encryption can be turned on without code changes.
+func applyOptions(conf *Config, opts ...Option) {
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	if conf.cipher == nil {
+		if pass := os.Getenv("READCONF_PASSPHRASE"); pass != "" {
+			WithPassphrase(fixedPassphrase([]byte(pass)))(conf)
+		}
+	}
+}
+
 // Listens for changes on the configuration, and returns the read configs.
-func (c *Config) Listen() (*ConfigData, error) {
+// By default it uses the platform's native watch API (see newWatcher);
+// pass WithWatcher or WithPollInterval to use something else.
+//
+// Every built-in Watcher watches the real disk directly, bypassing the
+// Config's Filesystem -- there is no inotify/kqueue/ReadDirectoryChangesW
+// equivalent for a MemFilesystem. Listen asks the Filesystem for a
+// watchable path via WatchPath and fails with an error if it can't
+// provide one, rather than silently watching the wrong location.
+//
+// The returned goroutine exits, closing both channels, when ctx is done;
+// every send inside it also selects on ctx.Done() so a consumer that stops
+// receiving cannot wedge the watcher open forever. The OpCreate/OpWrite
+// events a single atomic Write produces are coalesced into one read,
+// within coalesceWindow.
+func (c *Config) Listen(ctx context.Context, opts ...ListenOption) (*ConfigData, error) {
+
+	var lo listenOptions
+	for _, opt := range opts {
+		opt(&lo)
+	}
+
+	watcher := lo.watcher
+	if watcher == nil {
+		w, err := newWatcher()
+		if err != nil {
+			return nil, err
+		}
+		watcher = w
+	}
+
+	watchPath, ok := c.fs.WatchPath(c.getPath())
+	if !ok {
+		watcher.Close()
+		return nil, fmt.Errorf("readconf: Listen needs a Filesystem whose files live on a watchable path; %T does not provide one for %s", c.fs, c.getPath())
+	}
 
 	data := make(chan []byte)
 	errs := make(chan error)
 	conf := ConfigData{data, errs}
 
-	watcher, err := inotify.NewWatcher()
-	if err != nil {
+	if err := watcher.Add(watchPath); err != nil {
+		watcher.Close()
 		return nil, err
 	}
 
-	confName := c.getPath()
+	go func() {
+		defer watcher.Close()
+		defer close(data)
+		defer close(errs)
 
-	err = watcher.Watch(confName)
-	if err != nil {
-		return nil, err
-	}
+		fire := make(chan struct{}, 1)
+		var pending *time.Timer
 
-	go func() {
 		for {
 			select {
-			case ev := <-watcher.Event:
-				switch ev.Mask {
-				case inotify.IN_MODIFY:
-					fallthrough
-				case inotify.IN_MOVE_SELF:
-					fallthrough
-				case inotify.IN_DELETE_SELF:
-				default:
+			case <-ctx.Done():
+				return
+
+			case ev := <-watcher.Events():
+				if ev.Op&(OpCreate|OpWrite) == 0 {
 					continue
 				}
-				// ISSUE Fix having to wait to read file after event has happened to get file content
-				<-time.After(5e7)
 
-				if newConf, err := c.Read(); err != nil {
-					errs <- err
+				if pending == nil {
+					pending = time.AfterFunc(coalesceWindow, func() {
+						select {
+						case fire <- struct{}{}:
+						case <-ctx.Done():
+						}
+					})
+				} else {
+					pending.Reset(coalesceWindow)
+				}
+
+			case <-fire:
+				pending = nil
+
+				if newConf, err := c.Read(ctx); err != nil {
+					select {
+					case errs <- err:
+					case <-ctx.Done():
+						return
+					}
 				} else {
-					data <- newConf
+					select {
+					case data <- newConf:
+					case <-ctx.Done():
+						return
+					}
 				}
 
 			// FEATURE could handle writes as well
 			// case newConf := <-conf.Data:
-			// 	c.Write(newConf)
+			// 	c.Write(ctx, newConf)
 
-			case err := <-watcher.Error:
-				errs <- err
+			case err := <-watcher.Errors():
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
 			}
 
 		}
@@ -86,10 +205,27 @@ func (c *Config) Listen() (*ConfigData, error) {
 	return &conf, nil
 }
 
-// Write contents to the configuration
-func (c *Config) Write(newConf []byte) (n int, err error) {
+// Write atomically replaces the configuration with newConf. If a Cipher
+// is configured (see WithPassphrase), newConf is encrypted first; n still
+// reports how much of newConf was accepted, matching the io.Writer
+// convention, even though the encrypted form written to disk is longer.
+// The new content is written to a temp file beside the target, fsynced,
+// and renamed over it, so that Listen (or a crash) never observes a
+// half-written file; the parent directory is then fsynced so the rename
+// itself is durable.
+func (c *Config) Write(ctx context.Context, newConf []byte) (n int, err error) {
+
+	toWrite := newConf
+	if c.cipher != nil {
+		if toWrite, err = c.cipher.Encrypt(newConf); err != nil {
+			return 0, err
+		}
+	}
+
+	dir := path.Dir(c.getPath())
+	tmpPath := path.Join(dir, fmt.Sprintf(".%s.tmp-%d-%d", c.confName, os.Getpid(), atomic.AddUint64(&tmpSeq, 1)))
 
-	file, err := os.Create(c.getPath())
+	tmp, err := c.fs.Create(tmpPath)
 	if err != nil {
 		return 0, err
 	}
@@ -97,20 +233,155 @@ func (c *Config) Write(newConf []byte) (n int, err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	return file.Write(newConf)
+	if _, err = tmp.Write(toWrite); err != nil {
+		tmp.Close()
+		c.fs.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		c.fs.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err = tmp.Close(); err != nil {
+		c.fs.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err = c.fs.Rename(tmpPath, c.getPath()); err != nil {
+		c.fs.Remove(tmpPath)
+		return 0, err
+	}
+
+	return len(newConf), c.fs.SyncDir(dir)
 }
 
-// Return the contents of the configuration
-func (c *Config) Read() ([]byte, error) {
+// Return the contents of the configuration. If a Cipher is configured
+// (see WithPassphrase) and the stored bytes carry its magic header, they
+// are transparently decrypted first; a plaintext legacy file is returned
+// as-is.
+func (c *Config) Read(ctx context.Context) ([]byte, error) {
 
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	return ioutil.ReadFile(c.getPath())
+	data, err := c.fs.ReadFile(c.getPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cipher != nil && isEncrypted(data) {
+		return c.cipher.Decrypt(data)
+	}
+	return data, nil
+}
+
+// ReadInto reads the configuration and decodes it into v using the Config's
+// Codec, which is chosen from confName's file extension unless overridden
+// with WithCodec.
+func (c *Config) ReadInto(ctx context.Context, v interface{}) error {
+	data, err := c.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(data, v)
+}
+
+// WriteFrom encodes v with the Config's Codec and writes the result to the
+// configuration file.
+func (c *Config) WriteFrom(ctx context.Context, v interface{}) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ctx, data)
+	return err
+}
+
+// bufPool holds scratch buffers for ListenInto, avoiding an allocation per
+// decoded change.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// ListenInto behaves like Listen, but decodes each change into v with the
+// Config's Codec instead of handing back the raw bytes. The returned
+// channel fires once per successful decode; decode errors are sent on the
+// error channel instead. The caller must not read v concurrently with a
+// pending decode. Both returned channels are always closed together, once
+// ctx is done, once the error of a Listen that failed outright has been
+// received, or once Listen's channels close. Every send selects on
+// ctx.Done(), so cancelling ctx releases the goroutine even if the caller
+// has stopped receiving; until then, a caller that ranges over only one of
+// the two channels blocks while a value waits unreceived on the other.
+func (c *Config) ListenInto(ctx context.Context, v interface{}, opts ...ListenOption) (<-chan struct{}, <-chan error) {
+	updates := make(chan struct{})
+	errs := make(chan error)
+
+	conf, err := c.Listen(ctx, opts...)
+	if err != nil {
+		go func() {
+			defer close(updates)
+			defer close(errs)
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+			}
+		}()
+		return updates, errs
+	}
+
+	go func() {
+		defer close(updates)
+		defer close(errs)
+
+		for {
+			select {
+			case data, ok := <-conf.Data:
+				if !ok {
+					return
+				}
+
+				buf := bufPool.Get().(*bytes.Buffer)
+				buf.Reset()
+				buf.Write(data)
+				err := c.codec.Unmarshal(buf.Bytes(), v)
+				bufPool.Put(buf)
+
+				if err != nil {
+					select {
+					case errs <- err:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				select {
+				case updates <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+
+			case err, ok := <-conf.Error:
+				if !ok {
+					return
+				}
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return updates, errs
 }
 
 func (c *Config) Exists() bool {
-	_, err := os.Stat(c.getPath())
+	_, err := c.fs.Stat(c.getPath())
 	return err == nil
 }
 
@@ -138,73 +409,79 @@ func splitPath(fullPath string) (programPath, programName, confName string, err
 
 }
 
-// Copy a configuration to a path
-func (c *Config) copyConf(programPath, programName, confName string) (*Config, error) {
+// Copy a configuration to a path, applying opts (notably WithPassphrase)
+// before the copy is written, so that e.g. an /etc configuration is
+// re-encrypted on the way into the user directory rather than copied
+// byte-for-byte.
+func (c *Config) copyConf(ctx context.Context, programPath, programName, confName string, opts ...Option) (*Config, error) {
 
-	isTmp := false
-	if programPath == "/tmp" {
-		isTmp = true
-	}
+	isTmp := programPath == FromContext(ctx).tmpRoot()
+
+	newConf := &Config{programPath, programName, confName, isTmp, codecForExt(confName), FromContext(ctx).filesystem(), nil, sync.RWMutex{}}
+	applyOptions(newConf, opts...)
 
-	newConf := Config{programPath, programName, confName, isTmp, sync.RWMutex{}}
-	err := newConf.read(c)
-	return &newConf, err
+	err := newConf.read(ctx, c)
+	return newConf, err
 }
 
-// Returns a copy of the config which relies in /tmp
-func (c *Config) makeTmp() (*Config, error) {
-	return c.copyConf("/tmp", c.programName, c.confName)
+// Returns a copy of the config which relies in the tmp root (/tmp unless
+// overridden through the context's Options). opts is forwarded to
+// copyConf so that e.g. WithPassphrase still encrypts this copy on disk,
+// not just the in-memory Config returned afterward.
+func (c *Config) makeTmp(ctx context.Context, opts ...Option) (*Config, error) {
+	return c.copyConf(ctx, FromContext(ctx).tmpRoot(), c.programName, c.confName, opts...)
 }
 
 // Creates a Config struct if Config exists
-func findConfig(configPath, programName, confName string) (*Config, error) {
-	conf := Config{configPath, programName, confName, true, sync.RWMutex{}}
+func findConfig(fs Filesystem, configPath, programName, confName string, opts ...Option) (*Config, error) {
+	conf := &Config{configPath, programName, confName, true, codecForExt(confName), fs, nil, sync.RWMutex{}}
+	applyOptions(conf, opts...)
+
 	if conf.Exists() {
-		return &conf, nil
+		return conf, nil
 	}
 
 	return nil, errors.New(fmt.Sprint("Config does not exist in", conf.getPath()))
 }
 
-// Returns the system specific Config
-func getSysConfig(programName, confName string) (*Config, error) {
-	return findConfig("/etc", programName, confName)
+// Returns the system specific Config, searched under the context's etc
+// root (/etc unless overridden through Options)
+func getSysConfig(ctx context.Context, programName, confName string) (*Config, error) {
+	return findConfig(FromContext(ctx).filesystem(), FromContext(ctx).etcRoot(), programName, confName)
 }
 
-// Read in another configuration file
-func (c *Config) read(from *Config) error {
+// Read in another configuration file, transparently re-encrypting it for
+// c's own Cipher (if any) regardless of how from stored it -- this is how
+// copyConf turns a plaintext /etc configuration into an encrypted user
+// copy.
+func (c *Config) read(ctx context.Context, from *Config) error {
 
 	// Create parent directories if necessary with full permissions for user, none for the rest
-	if err := os.MkdirAll(path.Join(c.programPath, c.programName), 0700); err != nil {
+	if err := c.fs.MkdirAll(path.Join(c.programPath, c.programName), 0700); err != nil {
 		return err
 	}
-	// Copy, truncate destination if it exists
-	fromFile, err := os.Open(from.getPath())
-	if err != nil {
-		return err
-	}
-	defer fromFile.Close()
 
-	toFile, err := os.Create(c.getPath())
+	data, err := from.Read(ctx)
 	if err != nil {
 		return err
 	}
-	defer toFile.Close()
 
-	if _, err := io.Copy(toFile, fromFile); err != nil {
-		return err
+	if c.cipher != nil {
+		if data, err = c.cipher.Encrypt(data); err != nil {
+			return err
+		}
 	}
-	return nil
 
+	return c.fs.WriteFile(c.getPath(), data, 0600)
 }
 
-func copySysConfig(programPath, programName, confName string) (*Config, error) {
-	sysConf, err := getSysConfig(programName, confName)
+func copySysConfig(ctx context.Context, programPath, programName, confName string, opts ...Option) (*Config, error) {
+	sysConf, err := getSysConfig(ctx, programName, confName)
 	if err != nil {
 		return nil, err
 	}
 
-	return sysConf.copyConf(programPath, programName, confName)
+	return sysConf.copyConf(ctx, programPath, programName, confName, opts...)
 
 }
 
@@ -216,34 +493,53 @@ func copySysConfig(programPath, programName, confName string) (*Config, error) {
 // It then copies the system configuration to tmp and returns a configuration which can be modified.
 // Otherwise, the system configuration is returned.
 // If no system configuration can be retrieved, the program returns an error.
-func Get(programName, confName string) (*Config, error) {
-
-	programPath := os.Getenv("XDG_CONFIG_HOME")
+//
+// Between the user directory and /etc, it also honours $XDG_CONFIG_DIRS
+// (a colon-separated list, per the XDG base directory spec): the first
+// entry with a matching configuration is used as-is, without being copied
+// into the user directory, since those directories are conventionally
+// read-only system fallbacks rather than something a user edits.
+func Get(ctx context.Context, programName, confName string, opts ...Option) (*Config, error) {
+
+	userOpts := FromContext(ctx)
+	programPath := userOpts.xdgConfigHome()
 	if programPath == "" {
-		programPath = path.Join(os.Getenv("HOME"), ".config")
+		programPath = path.Join(userOpts.home(), ".config")
+	}
+
+	apply := func(conf *Config) *Config {
+		for _, opt := range opts {
+			opt(conf)
+		}
+		return conf
 	}
 
 	// Managed to set user path, so try to fetch and or create config here
 	if programPath != ".config" {
-		if conf, err := findConfig(programPath, programName, confName); err != nil {
-			userConf, err := copySysConfig(programPath, programName, confName)
-			if err == nil {
-				return userConf, nil
+		if conf, err := findConfig(userOpts.filesystem(), programPath, programName, confName, opts...); err == nil {
+			return apply(conf), nil
+		}
+
+		for _, dir := range xdgConfigDirs() {
+			if conf, err := findConfig(userOpts.filesystem(), dir, programName, confName); err == nil {
+				return apply(conf), nil
 			}
-		} else {
-			return conf, nil
+		}
+
+		if userConf, err := copySysConfig(ctx, programPath, programName, confName, opts...); err == nil {
+			return apply(userConf), nil
 		}
 	}
 
 	// Try to fetch the system config
-	sysConf, err := getSysConfig(programName, confName)
+	sysConf, err := getSysConfig(ctx, programName, confName)
 	if err != nil {
 		return nil, err
 	}
 
-	tmpConf, err := sysConf.makeTmp()
+	tmpConf, err := sysConf.makeTmp(ctx, opts...)
 	if err != nil { // Try to copy to tmp
-		return sysConf, nil
+		return apply(sysConf), nil
 	}
-	return tmpConf, nil
+	return apply(tmpConf), nil
 }
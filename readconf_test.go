@@ -2,136 +2,132 @@ package readconf
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
 	"testing"
+	"time"
 )
 
 const (
 	changeCnt          = 500
-	timeout            = 2e9
-	programName string = "fonts" // Hopefully existing on all unixes
+	programName string = "fonts"
 	confName    string = "fonts.conf"
 	seed               = 100
 )
 
-var (
-	home     string
-	XDGHome  string
-	confPath string
-)
-
-// Clearing of environment
-// Needed environment has to be set explicitly as it is not local to functions
+// init neutralises $XDG_CONFIG_DIRS, $XDG_CONFIG_HOME, and $HOME so that
+// xdgConfigDirs() and the environment fallbacks of Options can't pick up
+// stray entries or a user directory from the host running the tests; every
+// search root a test needs is threaded through Options (see newTestRoots)
+// instead, so tests don't depend on the host's real /etc, /tmp, or home.
 func init() {
-	home = os.Getenv("HOME")
-	XDGHome = os.Getenv("XDG_CONFIG_HOME")
-	confPath = path.Join("/etc", programName, confName)
-	os.Clearenv()
-	// TODO Clean up test files
+	os.Unsetenv("XDG_CONFIG_DIRS")
+	os.Unsetenv("XDG_CONFIG_HOME")
+	os.Unsetenv("HOME")
 }
 
-func exists(path string) bool {
-
-	_, err := os.Stat(path)
-	if err != nil {
-		return os.IsExist(err)
+// newTestRoots creates a throwaway etc/xdg/tmp layout under t.TempDir()
+// with a system configuration already written, and returns a context
+// pointed at it. Tests that want a resolvable user directory too should
+// add XDGConfigHome: xdgHome to a further WithOptions call.
+func newTestRoots(t *testing.T) (ctx context.Context, etcRoot, xdgHome, tmpRoot string) {
+	t.Helper()
+
+	base := t.TempDir()
+	etcRoot = path.Join(base, "etc")
+	xdgHome = path.Join(base, "xdg")
+	tmpRoot = path.Join(base, "tmp")
+
+	for _, dir := range []string{etcRoot, xdgHome, tmpRoot} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
 	}
-	return true
-}
 
-// Test if our system config is existing
-
-func TestSystemConfigIsExisting(t *testing.T) {
-
-	if !exists(confPath) {
-		t.Fatal(confPath, "does not exist: cannot do testing")
+	sysDir := path.Join(etcRoot, programName)
+	if err := os.MkdirAll(sysDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(sysDir, confName), []byte("system default\n"), 0600); err != nil {
+		t.Fatal(err)
 	}
-}
 
-// return a setup for a program whose config is existing / nonexisting
-func getConfigSetup(confPath, programName string, shouldExist bool) string {
+	ctx = WithOptions(context.Background(), Options{
+		EtcRoot: etcRoot,
+		TmpRoot: tmpRoot,
+	})
+	return ctx, etcRoot, xdgHome, tmpRoot
+}
 
-	for {
-		programName = string(randStr(10))
-		isExisting := exists(path.Join(confPath, programName))
-		if shouldExist && !isExisting {
-			continue
-		}
-		if !shouldExist && isExisting {
-			continue
-		}
+// Test that getSysConfig finds a config under our own throwaway etc root,
+// rather than depending on a real system file (e.g. /etc/fonts/fonts.conf)
+// existing on the host running the tests.
+func TestSystemConfigIsExisting(t *testing.T) {
+	ctx, etcRoot, _, _ := newTestRoots(t)
 
-		break
+	if _, err := getSysConfig(ctx, programName, confName); err != nil {
+		t.Fatal("system config not found under", etcRoot, ":", err)
 	}
-	return programName
 }
 
-// Test for no existence of config and)no environment
+// Test for no existence of a system config
 func TestGetNoSysConfig(t *testing.T) {
+	ctx, _, _, _ := newTestRoots(t)
 
-	programName := getConfigSetup("/etc", programName, false)
-
-	_, err := Get(programName, confName)
-	if err == nil {
-		t.Fatal("Received nil when no system config exists:", err)
+	if _, err := Get(ctx, programName+"-missing", confName); err == nil {
+		t.Fatal("Received nil when no system config exists")
 	}
-
 }
 
-// Test for existence o) sysconfig but no user config
+// Test for existence of a system config but no user config
 func TestGetSysConfig(t *testing.T) {
+	ctx, _, _, _ := newTestRoots(t)
 
-	if _, err := Get(programName, confName); err != nil {
+	if _, err := Get(ctx, programName, confName); err != nil {
 		t.Fatal("Got error when system config exists:", err)
 	}
 }
 
-func setEnv(t *testing.T) {
-
-	if err := os.Setenv("HOME", home); err != nil {
-		t.Skip("Could not set $HOME:", err)
-	}
-
-	if err := os.Setenv("XDG_CONFIG_HOME", XDGHome); err != nil {
-		t.Skip("Could not set XDG_CONFIG_HOME:", err)
-	}
-
-}
-
-// Test for user environment but no user config
+// Test for no resolvable user directory, then one appearing
 func TestGetTmpConfig(t *testing.T) {
+	ctx, etcRoot, xdgHome, tmpRoot := newTestRoots(t)
 
-	if !exists(confPath) {
-		t.SkipNow()
-	}
-
-	// getting system config because no user environment can be found
-	if _, err := Get(programName, confName); err != nil {
+	// No user directory can be resolved yet, so Get falls back to a /tmp
+	// copy of the system config.
+	tmpConf, err := Get(ctx, programName, confName)
+	if err != nil {
 		t.Fatal("Could not create user config in tmp:", err)
 	}
+	if !tmpConf.isTemporary {
+		t.Error("Expected a tmp copy when no user config directory is set")
+	}
 
-	// set the home
-	setEnv(t)
-	if _, err := Get(programName, confName); err != nil {
+	// Now a user directory resolves; Get should copy the system config
+	// into it instead of /tmp.
+	ctx = WithOptions(ctx, Options{EtcRoot: etcRoot, TmpRoot: tmpRoot, XDGConfigHome: xdgHome})
+	userConf, err := Get(ctx, programName, confName)
+	if err != nil {
 		t.Fatal("Could not get user config:", err)
 	}
-
+	if userConf.isTemporary {
+		t.Error("Expected a user copy, not a tmp one, once XDGConfigHome is set")
+	}
 }
 
 // Test Listen
 
 func TestListen(t *testing.T) {
+	ctx, _, _, _ := newTestRoots(t)
 
-	conf, err := Get(programName, confName)
+	conf, err := Get(ctx, programName, confName)
 	if err != nil {
 		t.Fatal("Got error on creating conf:", err)
 	}
 
-	listen, err := conf.Listen()
+	listen, err := conf.Listen(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -143,15 +139,16 @@ func TestListen(t *testing.T) {
 	b := make([]byte, length)
 	for i := 0; i < changeCnt; i++ {
 		copy(b, randStr(length))
-		ioutil.WriteFile(fileName, b, os.ModePerm)
+		if err := ioutil.WriteFile(fileName, b, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
 
 		select {
 		case err := <-listen.Error:
 			t.Error(err)
 
 		case conf := <-listen.Data:
-			fmt.Println("got", string(conf))
-			if bytes.Compare(conf, b) != 0 {
+			if !bytes.Equal(conf, b) {
 				t.Error("Could not read the same as what was written. Got:",
 					string(conf), "Sent:", string(b))
 			}
@@ -160,9 +157,263 @@ func TestListen(t *testing.T) {
 	}
 
 	if r != changeCnt {
-		t.Error("Should have detected", changeCnt, " file changes, detected:", r, "changes")
+		t.Error("Should have detected", changeCnt, "file changes, detected:", r, "changes")
+	}
+}
+
+// Test Listen against a non-default Watcher, since the platform default
+// only ever gets exercised implicitly by TestListen.
+func TestListenWithPollWatcher(t *testing.T) {
+	ctx, _, _, _ := newTestRoots(t)
+
+	conf, err := Get(ctx, programName, confName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listen, err := conf.Listen(ctx, WithPollInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(conf.getPath(), []byte("polled change"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-listen.Error:
+		t.Fatal(err)
+	case data := <-listen.Data:
+		if string(data) != "polled change" {
+			t.Error("got", string(data), "want polled change")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for PollWatcher to report the change")
+	}
+}
+
+// Test Get, Read, and Write against a MemFilesystem, and that Listen
+// refuses to run against one instead of silently watching the wrong path.
+func TestMemFilesystemReadWrite(t *testing.T) {
+	fs := NewMemFilesystem()
+	ctx := WithOptions(context.Background(), Options{EtcRoot: "/etc", TmpRoot: "/tmp", FS: fs})
+
+	if err := fs.MkdirAll(path.Join("/etc", programName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(path.Join("/etc", programName, confName), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Get(ctx, programName, confName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := conf.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error("got", string(data), "want hello")
+	}
+
+	if _, err := conf.Write(ctx, []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = conf.Read(ctx); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "updated" {
+		t.Error("got", string(data), "want updated")
+	}
+
+	if _, err := conf.Listen(ctx); err == nil {
+		t.Error("expected Listen to fail on a MemFilesystem, which has no watchable path")
+	}
+}
+
+// Test that ReadInto/WriteFrom round-trip through a Codec picked from the
+// file extension.
+func TestJSONCodecRoundTrip(t *testing.T) {
+	ctx, etcRoot, xdgHome, tmpRoot := newTestRoots(t)
+
+	sysDir := path.Join(etcRoot, programName)
+	if err := ioutil.WriteFile(path.Join(sysDir, "settings.json"), []byte(`{"name":"bob"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx = WithOptions(ctx, Options{EtcRoot: etcRoot, TmpRoot: tmpRoot, XDGConfigHome: xdgHome})
+
+	conf, err := Get(ctx, programName, "settings.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type settings struct {
+		Name string `json:"name"`
+	}
+
+	var got settings
+	if err := conf.ReadInto(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "bob" {
+		t.Error("got", got.Name, "want bob")
+	}
+
+	if err := conf.WriteFrom(ctx, &settings{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got = settings{}
+	if err := conf.ReadInto(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "alice" {
+		t.Error("got", got.Name, "want alice")
+	}
+}
+
+// Test that Layered merges layers with the right precedence and that
+// Reset only ever writes the user's own layer, materializing one first if
+// the user doesn't have one yet.
+func TestLayeredMergeAndReset(t *testing.T) {
+	ctx, etcRoot, xdgHome, tmpRoot := newTestRoots(t)
+
+	sysDir := path.Join(etcRoot, programName)
+	if err := ioutil.WriteFile(path.Join(sysDir, "settings.ini"), []byte("name=sys\nport=80\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx = WithOptions(ctx, Options{EtcRoot: etcRoot, TmpRoot: tmpRoot, XDGConfigHome: xdgHome})
+
+	layered, err := NewLayered(ctx, programName, "settings.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := layered.Merge(ctx)["name"]; got != "sys" {
+		t.Fatal("got", got, "want sys")
+	}
+
+	// No user layer exists yet; Reset must materialize one rather than
+	// writing "name" out of the system layer.
+	if err := layered.Reset(ctx, "name"); err != nil {
+		t.Fatal(err)
+	}
+	if origin := layered.Origin(ctx, "name"); origin != path.Join(sysDir, "settings.ini") {
+		t.Error("expected name to still resolve from the system layer after Reset, got origin", origin)
+	}
+	if sysData, err := ioutil.ReadFile(path.Join(sysDir, "settings.ini")); err != nil {
+		t.Fatal(err)
+	} else if string(sysData) != "name=sys\nport=80\n" {
+		t.Error("Reset must not have touched the system layer, got:", string(sysData))
+	}
+
+	// Give the user their own override; it should win over the system
+	// layer, and Reset should now remove it from there specifically.
+	userDir := path.Join(xdgHome, programName)
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(userDir, "settings.ini"), []byte("name=user\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	layered, err = NewLayered(ctx, programName, "settings.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := layered.Merge(ctx)["name"]; got != "user" {
+		t.Fatal("got", got, "want user (user layer should win)")
+	}
+
+	if err := layered.Reset(ctx, "name"); err != nil {
+		t.Fatal(err)
+	}
+	if got := layered.Merge(ctx)["name"]; got != "sys" {
+		t.Error("got", got, "want sys (Reset should fall back to the system layer)")
+	}
+}
+
+// Test SecretboxCipher in isolation: Encrypt produces the magic header,
+// Decrypt reverses it, and the wrong passphrase fails rather than
+// returning garbage.
+func TestSecretboxCipherRoundTrip(t *testing.T) {
+	cipher := NewSecretboxCipher(fixedPassphrase([]byte("correct horse battery staple")), []byte("salt"))
+
+	ciphertext, err := cipher.Encrypt([]byte("plaintext config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(ciphertext) {
+		t.Error("expected the ciphertext to carry the magic header")
+	}
+
+	plaintext, err := cipher.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "plaintext config" {
+		t.Error("got", string(plaintext), "want plaintext config")
+	}
+
+	wrong := NewSecretboxCipher(fixedPassphrase([]byte("wrong passphrase")), []byte("salt"))
+	if _, err := wrong.Decrypt(ciphertext); err == nil {
+		t.Error("expected decryption with the wrong passphrase to fail")
+	}
+}
+
+// Test WithPassphrase end-to-end: the /tmp copy Get makes from /etc is
+// encrypted on the way in, Write keeps it encrypted, and Read transparently
+// decrypts both.
+func TestConfigWithPassphraseEncryptsAtRest(t *testing.T) {
+	fs := NewMemFilesystem()
+	ctx := WithOptions(context.Background(), Options{EtcRoot: "/etc", TmpRoot: "/tmp", FS: fs})
+
+	sysPath := path.Join("/etc", programName, confName)
+	if err := fs.MkdirAll(path.Join("/etc", programName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(sysPath, []byte("legacy plaintext"), 0600); err != nil {
+		t.Fatal(err)
 	}
 
+	conf, err := Get(ctx, programName, confName, WithPassphrase(fixedPassphrase([]byte("hunter2"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sysData, err := fs.ReadFile(sysPath); err != nil {
+		t.Fatal(err)
+	} else if isEncrypted(sysData) {
+		t.Error("did not expect the /etc original to be touched")
+	}
+
+	if tmpData, err := fs.ReadFile(conf.getPath()); err != nil {
+		t.Fatal(err)
+	} else if !isEncrypted(tmpData) {
+		t.Error("expected the /tmp copy to carry the magic header")
+	}
+
+	if data, err := conf.Read(ctx); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "legacy plaintext" {
+		t.Error("got", string(data), "want legacy plaintext")
+	}
+
+	if _, err := conf.Write(ctx, []byte("new secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if raw, err := fs.ReadFile(conf.getPath()); err != nil {
+		t.Fatal(err)
+	} else if !isEncrypted(raw) {
+		t.Error("expected bytes on disk to stay encrypted across Write")
+	}
+
+	if data, err := conf.Read(ctx); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "new secret" {
+		t.Error("got", string(data), "want new secret")
+	}
 }
 
 func randStr(length int) []byte {
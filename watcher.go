@@ -0,0 +1,62 @@
+package readconf
+
+import "time"
+
+// Op describes the kind of change a Watcher reported for a path.
+type Op uint8
+
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+)
+
+// Event is a single change reported by a Watcher for one of the paths
+// passed to Add.
+type Event struct {
+	Name string
+	Op   Op
+}
+
+// Watcher reports changes to files it has been asked to Add, abstracting
+// over the platform's native watch API so that Config.Listen runs
+// unmodified on Linux (inotify), BSD/macOS (kqueue), and Windows
+// (ReadDirectoryChangesW). PollWatcher works on any of these but is used
+// only when asked for with WithPollInterval or WithWatcher; no other
+// platform has a default Watcher.
+// Implementations are responsible for surviving a file being replaced by
+// rename, which is how Write updates a configuration.
+type Watcher interface {
+	Add(path string) error
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+// ListenOption configures the Watcher used by Config.Listen.
+type ListenOption func(*listenOptions)
+
+type listenOptions struct {
+	watcher Watcher
+}
+
+// WithWatcher makes Listen use w instead of the platform's default
+// Watcher. Listen takes w over: it treats every event w reports as a
+// change to its own configuration, and closes w when ctx is done or when
+// Listen itself fails.
+func WithWatcher(w Watcher) ListenOption {
+	return func(o *listenOptions) {
+		o.watcher = w
+	}
+}
+
+// WithPollInterval makes Listen use a PollWatcher that stats the
+// configuration every d, instead of the platform's native watch API. This
+// is mainly useful on filesystems (network mounts, some container
+// overlays) where the native API doesn't report changes reliably.
+func WithPollInterval(d time.Duration) ListenOption {
+	return func(o *listenOptions) {
+		o.watcher = NewPollWatcher(d)
+	}
+}
@@ -0,0 +1,143 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package readconf
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// kqueueWatcher implements Watcher on BSD-derived kernels, including
+// macOS, using kqueue. A kqueue vnode watch tracks an open descriptor
+// rather than a path, and an atomic rename-over (as Write does) replaces
+// the directory entry without touching the old descriptor's inode, so
+// this watches each added file's parent directory for NOTE_WRITE and
+// re-stats the files of interest whenever the directory changes -- the
+// same approach fsnotify's kqueue backend uses.
+type kqueueWatcher struct {
+	kq      int
+	events  chan Event
+	errs    chan error
+	done    chan struct{}
+	dirFDs  map[string]int
+	watched map[string]os.FileInfo
+}
+
+// newWatcher returns the platform default Watcher for BSD/macOS.
+func newWatcher() (Watcher, error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+
+	kw := &kqueueWatcher{
+		kq:      kq,
+		events:  make(chan Event),
+		errs:    make(chan error),
+		done:    make(chan struct{}),
+		dirFDs:  make(map[string]int),
+		watched: make(map[string]os.FileInfo),
+	}
+	go kw.run()
+	return kw, nil
+}
+
+func (kw *kqueueWatcher) Add(path string) error {
+	dir := filepath.Dir(path)
+
+	if _, ok := kw.dirFDs[dir]; !ok {
+		fd, err := unix.Open(dir, unix.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		kev := unix.Kevent_t{}
+		unix.SetKevent(&kev, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR)
+		kev.Fflags = unix.NOTE_WRITE
+
+		if _, err := unix.Kevent(kw.kq, []unix.Kevent_t{kev}, nil, nil); err != nil {
+			unix.Close(fd)
+			return err
+		}
+		kw.dirFDs[dir] = fd
+	}
+
+	info, _ := os.Stat(path)
+	kw.watched[path] = info
+	return nil
+}
+
+func (kw *kqueueWatcher) run() {
+	events := make([]unix.Kevent_t, 8)
+
+	for {
+		select {
+		case <-kw.done:
+			return
+		default:
+		}
+
+		n, err := unix.Kevent(kw.kq, nil, events, nil)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			select {
+			case kw.errs <- err:
+			case <-kw.done:
+				return
+			}
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+
+		for path, prev := range kw.watched {
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				if prev != nil {
+					kw.watched[path] = nil
+					if !kw.emit(Event{Name: path, Op: OpRemove}) {
+						return
+					}
+				}
+
+			case prev == nil:
+				kw.watched[path] = info
+				if !kw.emit(Event{Name: path, Op: OpCreate}) {
+					return
+				}
+
+			case info.ModTime() != prev.ModTime() || info.Size() != prev.Size():
+				kw.watched[path] = info
+				if !kw.emit(Event{Name: path, Op: OpWrite}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (kw *kqueueWatcher) emit(ev Event) bool {
+	select {
+	case kw.events <- ev:
+		return true
+	case <-kw.done:
+		return false
+	}
+}
+
+func (kw *kqueueWatcher) Events() <-chan Event { return kw.events }
+func (kw *kqueueWatcher) Errors() <-chan error { return kw.errs }
+
+func (kw *kqueueWatcher) Close() error {
+	close(kw.done)
+	for _, fd := range kw.dirFDs {
+		unix.Close(fd)
+	}
+	return unix.Close(kw.kq)
+}
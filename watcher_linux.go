@@ -0,0 +1,154 @@
+// +build linux
+
+package readconf
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask is the set of events we ask the kernel to report for a
+// watched directory; translateMask narrows these down to the Op values
+// Watcher callers care about.
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_DELETE |
+	unix.IN_DELETE_SELF | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_MOVE_SELF
+
+// inotifyWatcher implements Watcher on Linux using raw inotify syscalls
+// from golang.org/x/sys/unix. Each added path's parent directory is
+// watched so that replacing the file by rename (as Write does) is still
+// observed; events for anything else in that directory are filtered out.
+type inotifyWatcher struct {
+	fd      int
+	events  chan Event
+	errs    chan error
+	done    chan struct{}
+	mu      sync.Mutex
+	wdDirs  map[int32]string
+	dirWds  map[string]int32
+	watched map[string]bool
+}
+
+// newWatcher returns the platform default Watcher for Linux.
+func newWatcher() (Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	iw := &inotifyWatcher{
+		fd:      fd,
+		events:  make(chan Event),
+		errs:    make(chan error),
+		done:    make(chan struct{}),
+		wdDirs:  make(map[int32]string),
+		dirWds:  make(map[string]int32),
+		watched: make(map[string]bool),
+	}
+	go iw.run()
+	return iw, nil
+}
+
+func (iw *inotifyWatcher) Add(path string) error {
+	dir := filepath.Dir(path)
+
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	if _, ok := iw.dirWds[dir]; !ok {
+		wd, err := unix.InotifyAddWatch(iw.fd, dir, inotifyMask)
+		if err != nil {
+			return err
+		}
+		iw.dirWds[dir] = int32(wd)
+		iw.wdDirs[int32(wd)] = dir
+	}
+	iw.watched[path] = true
+	return nil
+}
+
+// run reads raw inotify events off iw.fd until Close makes the read fail,
+// decoding each into an Event and filtering out anything for a path we
+// weren't asked to watch.
+func (iw *inotifyWatcher) run() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.PathMax))
+
+	for {
+		n, err := unix.Read(iw.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			select {
+			case iw.errs <- err:
+			case <-iw.done:
+			}
+			return
+		}
+		if n <= 0 {
+			return
+		}
+
+		offset := 0
+		for offset+unix.SizeofInotifyEvent <= n {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameLen := int(raw.Len)
+
+			var name string
+			if nameLen > 0 {
+				start := offset + unix.SizeofInotifyEvent
+				name = strings.TrimRight(string(buf[start:start+nameLen]), "\x00")
+			}
+			offset += unix.SizeofInotifyEvent + nameLen
+
+			iw.mu.Lock()
+			dir, ok := iw.wdDirs[raw.Wd]
+			if ok {
+				ok = iw.watched[filepath.Join(dir, name)]
+			}
+			iw.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			op := translateMask(raw.Mask)
+			if op == 0 {
+				continue
+			}
+
+			select {
+			case iw.events <- Event{Name: filepath.Join(dir, name), Op: op}:
+			case <-iw.done:
+				return
+			}
+		}
+	}
+}
+
+func translateMask(mask uint32) Op {
+	var op Op
+	if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		op |= OpCreate
+	}
+	if mask&unix.IN_MODIFY != 0 {
+		op |= OpWrite
+	}
+	if mask&(unix.IN_DELETE|unix.IN_DELETE_SELF) != 0 {
+		op |= OpRemove
+	}
+	if mask&(unix.IN_MOVE_SELF|unix.IN_MOVED_FROM) != 0 {
+		op |= OpRename
+	}
+	return op
+}
+
+func (iw *inotifyWatcher) Events() <-chan Event { return iw.events }
+func (iw *inotifyWatcher) Errors() <-chan error { return iw.errs }
+
+func (iw *inotifyWatcher) Close() error {
+	close(iw.done)
+	return unix.Close(iw.fd)
+}
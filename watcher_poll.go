@@ -0,0 +1,88 @@
+package readconf
+
+import (
+	"os"
+	"time"
+)
+
+// PollWatcher is the Watcher fallback for platforms, or filesystems,
+// without a reliable native watch API: it stats each added path on a
+// fixed interval and reports a change whenever the modification time or
+// size differs from the previous poll.
+type PollWatcher struct {
+	interval time.Duration
+	events   chan Event
+	errs     chan error
+	done     chan struct{}
+}
+
+// NewPollWatcher returns a PollWatcher that checks added paths every d.
+func NewPollWatcher(d time.Duration) *PollWatcher {
+	return &PollWatcher{
+		interval: d,
+		events:   make(chan Event),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add starts polling path, reporting it as created, written, or removed
+// relative to its state at the time of this call.
+func (p *PollWatcher) Add(path string) error {
+	info, _ := os.Stat(path)
+	go p.poll(path, info)
+	return nil
+}
+
+func (p *PollWatcher) poll(path string, prev os.FileInfo) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				if prev != nil {
+					prev = nil
+					if !p.emit(Event{Name: path, Op: OpRemove}) {
+						return
+					}
+				}
+				continue
+			}
+
+			switch {
+			case prev == nil:
+				if !p.emit(Event{Name: path, Op: OpCreate}) {
+					return
+				}
+			case info.ModTime() != prev.ModTime() || info.Size() != prev.Size():
+				if !p.emit(Event{Name: path, Op: OpWrite}) {
+					return
+				}
+			}
+			prev = info
+		}
+	}
+}
+
+func (p *PollWatcher) emit(ev Event) bool {
+	select {
+	case p.events <- ev:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *PollWatcher) Events() <-chan Event { return p.events }
+func (p *PollWatcher) Errors() <-chan error { return p.errs }
+
+func (p *PollWatcher) Close() error {
+	close(p.done)
+	return nil
+}
@@ -0,0 +1,155 @@
+// +build windows
+
+package readconf
+
+import (
+	"encoding/binary"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// FILE_NOTIFY_INFORMATION action codes; golang.org/x/sys/windows does not
+// export these.
+const (
+	fileActionAdded          = 0x1
+	fileActionRemoved        = 0x2
+	fileActionModified       = 0x3
+	fileActionRenamedOldName = 0x4
+	fileActionRenamedNewName = 0x5
+)
+
+// winWatcher implements Watcher on Windows via ReadDirectoryChangesW,
+// since neither inotify nor kqueue exist there. It watches a single
+// directory -- the parent of the first path Add'd to it -- and reports
+// only changes to the basenames that have been added.
+type winWatcher struct {
+	handle  windows.Handle
+	dir     string
+	watched map[string]bool
+	events  chan Event
+	errs    chan error
+	done    chan struct{}
+}
+
+// newWatcher returns the platform default Watcher for Windows.
+func newWatcher() (Watcher, error) {
+	return &winWatcher{
+		watched: make(map[string]bool),
+		events:  make(chan Event),
+		errs:    make(chan error),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (w *winWatcher) Add(path string) error {
+	w.watched[filepath.Base(path)] = true
+
+	dir := filepath.Dir(path)
+	if w.dir != "" {
+		return nil // already watching dir; assumes path shares it
+	}
+	w.dir = dir
+
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return err
+	}
+
+	h, err := windows.CreateFile(p,
+		windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	w.handle = h
+
+	go w.run()
+	return nil
+}
+
+func (w *winWatcher) run() {
+	buf := make([]byte, 4096)
+
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		var n uint32
+		err := windows.ReadDirectoryChanges(w.handle, &buf[0], uint32(len(buf)), false,
+			windows.FILE_NOTIFY_CHANGE_FILE_NAME|windows.FILE_NOTIFY_CHANGE_LAST_WRITE,
+			&n, nil, 0)
+		if err != nil {
+			select {
+			case w.errs <- err:
+			case <-w.done:
+				return
+			}
+			continue
+		}
+
+		for _, ev := range parseNotifyBuffer(buf[:n]) {
+			if !w.watched[ev.Name] {
+				continue
+			}
+			ev.Name = filepath.Join(w.dir, ev.Name)
+
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// parseNotifyBuffer walks a buffer of FILE_NOTIFY_INFORMATION records
+// filled in by ReadDirectoryChangesW. Event.Name is left as the bare
+// filename; run joins it onto the watched directory.
+func parseNotifyBuffer(buf []byte) []Event {
+	var out []Event
+
+	for offset := 0; offset < len(buf); {
+		action := binary.LittleEndian.Uint32(buf[offset+4:])
+		nameLen := binary.LittleEndian.Uint32(buf[offset+8:])
+		nameBytes := buf[offset+12 : offset+12+int(nameLen)]
+
+		u16 := make([]uint16, len(nameBytes)/2)
+		for i := range u16 {
+			u16[i] = binary.LittleEndian.Uint16(nameBytes[i*2:])
+		}
+
+		var op Op
+		switch action {
+		case fileActionAdded, fileActionRenamedNewName:
+			op = OpCreate
+		case fileActionModified:
+			op = OpWrite
+		case fileActionRemoved:
+			op = OpRemove
+		case fileActionRenamedOldName:
+			op = OpRename
+		}
+		out = append(out, Event{Name: windows.UTF16ToString(u16), Op: op})
+
+		nextEntry := binary.LittleEndian.Uint32(buf[offset:])
+		if nextEntry == 0 {
+			break
+		}
+		offset += int(nextEntry)
+	}
+
+	return out
+}
+
+func (w *winWatcher) Events() <-chan Event { return w.events }
+func (w *winWatcher) Errors() <-chan error { return w.errs }
+
+func (w *winWatcher) Close() error {
+	close(w.done)
+	return windows.CloseHandle(w.handle)
+}